@@ -4,26 +4,44 @@ import (
 	"compress/flate"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 )
 
 const (
-	messageTypeIndex       = 1
-	messageTypeRequest     = 2
-	messageTypeResponse    = 3
-	messageTypePing        = 4
-	messageTypePong        = 5
-	messageTypeIndexUpdate = 6
+	messageTypeIndex         = 1
+	messageTypeRequest       = 2
+	messageTypeResponse      = 3
+	messageTypePing          = 4
+	messageTypePong          = 5
+	messageTypeIndexUpdate   = 6
+	messageTypeResponseChunk = 7
+	messageTypeResponseEnd   = 8
+	messageTypeCancel        = 9
+	messageTypeHello         = 10
 )
 
+// responseChunkSize is the largest slice of a response we put in a single
+// messageTypeResponseChunk frame. Keeping it well below typical socket
+// buffer sizes lets the chunk channel apply backpressure instead of
+// ballooning memory for very large blocks.
+const responseChunkSize = 128 * 1024
+
 type FileInfo struct {
 	Name     string
 	Flags    uint32
 	Modified int64
+	// Sequence is a monotonically increasing number, scoped to the
+	// (folder, sending node) pair, that orders this entry relative to
+	// others in the same folder. It lets a peer resume an index exchange
+	// incrementally after reconnecting instead of rewalking the full set.
+	Sequence int64
 	Blocks   []BlockInfo
 }
 
@@ -33,16 +51,106 @@ type BlockInfo struct {
 }
 
 type Model interface {
-	// An index was received from the peer node
-	Index(nodeID string, files []FileInfo)
-	// An index update was received from the peer node
-	IndexUpdate(nodeID string, files []FileInfo)
+	// An index was received from the peer node for the given folder. seq
+	// is the highest FileInfo.Sequence received from the peer for this
+	// folder so far, this message included.
+	Index(nodeID, folder string, seq int64, files []FileInfo)
+	// An index update was received from the peer node for the given folder.
+	IndexUpdate(nodeID, folder string, seq int64, files []FileInfo)
 	// A request was made by the peer node
 	Request(nodeID, name string, offset uint64, size uint32, hash []byte) ([]byte, error)
 	// The peer node closed the connection
 	Close(nodeID string)
 }
 
+// StreamingModel may optionally be implemented by a Model to serve a
+// request as a stream of chunks instead of buffering the whole block in
+// memory. When the receiver implements it, Connection prefers it over
+// Request for answering incoming requests.
+type StreamingModel interface {
+	RequestStream(nodeID, name string, offset uint64, size uint32, hash []byte) (io.ReadCloser, error)
+}
+
+// CompressionAlgo identifies a wire compression algorithm negotiated
+// during the connection handshake.
+type CompressionAlgo int
+
+const (
+	CompressionNone CompressionAlgo = iota
+	CompressionFlate
+	CompressionZstd
+	CompressionLZ4
+)
+
+// ConnectionOptions configures the compression negotiated by
+// NewConnection. Compression lists the algorithms this side is willing
+// to use. Of the algorithms both peers list, the first in
+// canonicalCompressionOrder is used; the order of this list only matters
+// for its first entry, since CompressionNone there (on either side)
+// disables compression. CompressionNone is also used if nothing is
+// shared. Level is passed to
+// the chosen algorithm's writer where applicable.
+type ConnectionOptions struct {
+	Compression []CompressionAlgo
+	Level       int
+}
+
+// DefaultConnectionOptions matches the connection's previous hard-coded
+// behaviour: flate at BestSpeed, falling back to no compression if the
+// peer doesn't support it.
+func DefaultConnectionOptions() ConnectionOptions {
+	return ConnectionOptions{
+		Compression: []CompressionAlgo{CompressionFlate, CompressionNone},
+		Level:       flate.BestSpeed,
+	}
+}
+
+// hello is exchanged, uncompressed, before any other traffic so both
+// ends can agree on a compression algorithm for the rest of the session.
+type hello struct {
+	compression []CompressionAlgo
+	level       int32
+}
+
+// canonicalCompressionOrder breaks ties between the two peers'
+// preference lists. Picking by scanning one side's list in its own
+// order isn't symmetric - two peers whose lists contain the same
+// algorithms in different orders could each pick a different one -
+// which would leave each side decompressing with the wrong codec. Using
+// a fixed order that doesn't depend on which side is "local" guarantees
+// both ends of negotiateCompression(a, b) and negotiateCompression(b, a)
+// agree.
+var canonicalCompressionOrder = []CompressionAlgo{CompressionZstd, CompressionLZ4, CompressionFlate}
+
+// negotiateCompression picks the algorithm both local and remote
+// support, breaking ties with canonicalCompressionOrder, and defaults to
+// CompressionNone if either side's top preference is none or nothing is
+// shared.
+func negotiateCompression(local, remote []CompressionAlgo) CompressionAlgo {
+	if len(local) > 0 && local[0] == CompressionNone {
+		return CompressionNone
+	}
+	if len(remote) > 0 && remote[0] == CompressionNone {
+		return CompressionNone
+	}
+
+	localSet := make(map[CompressionAlgo]bool, len(local))
+	for _, a := range local {
+		localSet[a] = true
+	}
+	remoteSet := make(map[CompressionAlgo]bool, len(remote))
+	for _, a := range remote {
+		remoteSet[a] = true
+	}
+
+	for _, a := range canonicalCompressionOrder {
+		if localSet[a] && remoteSet[a] {
+			return a
+		}
+	}
+	return CompressionNone
+}
+
 type Connection struct {
 	sync.RWMutex
 
@@ -53,10 +161,37 @@ type Connection struct {
 	writer      io.Writer
 	mwriter     *marshalWriter
 	closed      bool
-	awaiting    map[int]chan asyncResult
-	nextId      int
-	peerLatency time.Duration
-	indexSent   map[string]int64
+	awaiting    map[int]chan chunkResult
+	// inFlightRequests and cancelled are both scoped to the lifetime of
+	// the processRequest goroutine they were created for: a msgID only
+	// ever has a cancelled entry while it's also in inFlightRequests, so
+	// a Cancel that arrives after the responder already finished (or for
+	// an msgID we never saw) is a no-op instead of leaving a stale true
+	// behind for a future request to inherit once the 12-bit ID wraps.
+	inFlightRequests map[int]bool
+	cancelled        map[int]bool
+	nextId           int
+	peerLatency      time.Duration
+	// indexSent holds, per folder, the highest FileInfo.Sequence we have
+	// sent to the peer, so a later Index call only needs to send the
+	// entries the peer doesn't already have.
+	indexSent map[string]int64
+	// indexReceived holds, per folder, the highest FileInfo.Sequence we
+	// have received from the peer.
+	indexReceived map[string]int64
+
+	// controlQueue carries latency-sensitive frames (Ping/Pong, Cancel,
+	// Request, and Index/IndexUpdate batches of up to about
+	// indexChunkSize bytes). dataQueue carries Response payloads; it holds
+	// only dataQueueSize frames, bounding memory for a peer that can't keep
+	// up. Both enqueue paths block while their queue is full, so control
+	// frames also wait once controlQueueSize of them are pending.
+	// writerLoop always drains controlQueue first so a saturated link
+	// doesn't starve pings.
+	controlQueue chan frame
+	dataQueue    chan frame
+	writeLimiter *writeLimiter
+	closedCh     chan struct{}
 
 	lastStatistics Statistics
 	statisticsLock sync.Mutex
@@ -65,127 +200,450 @@ type Connection struct {
 	lastReceiveLock sync.RWMutex
 }
 
+const (
+	controlQueueSize = 64
+	dataQueueSize    = 4
+)
+
+// frame is a queued, not-yet-written message: write appends its header
+// and body to the connection's marshalWriter, and size is the payload
+// size charged against the write-rate limiter.
+type frame struct {
+	write func(*marshalWriter)
+	size  int
+}
+
+// writeLimiter is a simple token bucket used to cap outgoing bytes per
+// second. A zero limit means unlimited.
+type writeLimiter struct {
+	mut      sync.Mutex
+	limit    int64
+	tokens   int64
+	lastFill time.Time
+}
+
+func (l *writeLimiter) setLimit(bytesPerSec int) {
+	l.mut.Lock()
+	l.limit = int64(bytesPerSec)
+	l.tokens = 0
+	l.lastFill = time.Now()
+	l.mut.Unlock()
+}
+
+// wait blocks until n bytes' worth of tokens are available, refilling
+// the bucket based on elapsed time since the last call. The bucket's
+// capacity is normally one second's worth of bytes (limit), but it is
+// temporarily raised to n for frames larger than that: otherwise a
+// frame bigger than the configured rate could never accumulate enough
+// tokens, since every refill would be capped back down to limit before
+// reaching n. writeFrame calls this synchronously from the single
+// writerLoop goroutine, so getting this wrong wedges the whole
+// connection, not just the frame being throttled.
+func (l *writeLimiter) wait(n int) {
+	for {
+		l.mut.Lock()
+		limit := l.limit
+		if limit <= 0 {
+			l.mut.Unlock()
+			return
+		}
+
+		now := time.Now()
+		l.tokens += int64(now.Sub(l.lastFill).Seconds() * float64(limit))
+		capacity := limit
+		if int64(n) > capacity {
+			capacity = int64(n)
+		}
+		if l.tokens > capacity {
+			l.tokens = capacity
+		}
+		l.lastFill = now
+
+		if l.tokens >= int64(n) {
+			l.tokens -= int64(n)
+			l.mut.Unlock()
+			return
+		}
+
+		wait := time.Duration(float64(int64(n)-l.tokens) / float64(limit) * float64(time.Second))
+		l.mut.Unlock()
+		time.Sleep(wait)
+	}
+}
+
 var ErrClosed = errors.New("Connection closed")
 
-type asyncResult struct {
-	val []byte
+// chunkResult is one frame of a (possibly chunked) response delivered to
+// an awaiting requester. A nil data with a nil err, delivered by the
+// channel being closed, signals a clean end of stream.
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// chunkReader adapts the chunk channel fed by readerLoop into an
+// io.ReadCloser, so a large response can be consumed incrementally
+// instead of being buffered in full before Request returns.
+type chunkReader struct {
+	c   *Connection
+	id  int
+	ch  chan chunkResult
+	buf []byte
 	err error
 }
 
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		res, ok := <-r.ch
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		if res.err != nil {
+			r.err = res.err
+			continue
+		}
+		r.buf = res.data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close aborts the request if it is still in flight, telling the peer to
+// stop sending chunks for it.
+func (r *chunkReader) Close() error {
+	r.c.cancelRequest(r.id)
+	return nil
+}
+
 const pingTimeout = 30 * time.Second
 const pingIdleTime = 5 * time.Minute
 
-func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver Model) *Connection {
-	flrd := flate.NewReader(reader)
-	flwr, err := flate.NewWriter(writer, flate.BestSpeed)
-	if err != nil {
-		panic(err)
+// ErrProtocolMismatch is returned by NewConnection when the peer doesn't
+// open with a hello message, meaning the two ends can't agree on framing
+// or compression for the rest of the session.
+var ErrProtocolMismatch = errors.New("protocol mismatch: peer did not send hello")
+
+func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver Model, opts ConnectionOptions) (*Connection, error) {
+	hr := &marshalReader{r: reader}
+	hw := &marshalWriter{w: writer}
+
+	hw.writeHeader(header{0, 0, messageTypeHello})
+	hw.writeHello(hello{compression: opts.Compression, level: int32(opts.Level)})
+	if f, ok := writer.(flusher); ok {
+		f.Flush()
 	}
 
+	hdr := hr.readHeader()
+	if hr.err != nil {
+		return nil, hr.err
+	}
+	if hdr.msgType != messageTypeHello {
+		return nil, ErrProtocolMismatch
+	}
+	peer := hr.readHello()
+	if hr.err != nil {
+		return nil, hr.err
+	}
+
+	rd, wr := negotiatedStreams(reader, writer, negotiateCompression(opts.Compression, peer.compression), opts.Level)
+
 	c := Connection{
 		receiver:       receiver,
-		reader:         flrd,
-		mreader:        &marshalReader{r: flrd},
-		writer:         flwr,
-		mwriter:        &marshalWriter{w: flwr},
-		awaiting:       make(map[int]chan asyncResult),
+		reader:         rd,
+		mreader:        &marshalReader{r: rd},
+		writer:         wr,
+		mwriter:        &marshalWriter{w: wr},
+		awaiting:       make(map[int]chan chunkResult),
+		controlQueue:   make(chan frame, controlQueueSize),
+		dataQueue:      make(chan frame, dataQueueSize),
+		writeLimiter:   &writeLimiter{},
+		closedCh:       make(chan struct{}),
 		lastReceive:    time.Now(),
 		ID:             nodeID,
 		lastStatistics: Statistics{At: time.Now()},
 	}
 
 	go c.readerLoop()
+	go c.writerLoop()
 	go c.pingerLoop()
 
-	return &c
+	return &c, nil
+}
+
+// SetWriteLimit caps the connection's outgoing byte rate. A limit of 0
+// (the default) means unlimited.
+func (c *Connection) SetWriteLimit(bytesPerSec int) {
+	c.writeLimiter.setLimit(bytesPerSec)
 }
 
-// Index writes the list of file information to the connected peer node
-func (c *Connection) Index(idx []FileInfo) {
+// negotiatedStreams wraps reader/writer in the reader/writer chain for
+// the given algorithm, or returns them unchanged for CompressionNone.
+func negotiatedStreams(reader io.Reader, writer io.Writer, algo CompressionAlgo, level int) (io.Reader, io.Writer) {
+	switch algo {
+	case CompressionFlate:
+		fw, err := flate.NewWriter(writer, level)
+		if err != nil {
+			panic(err)
+		}
+		return flate.NewReader(reader), fw
+
+	case CompressionZstd:
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			panic(err)
+		}
+		zw, err := zstd.NewWriter(writer)
+		if err != nil {
+			panic(err)
+		}
+		return zr, zw
+
+	case CompressionLZ4:
+		return lz4.NewReader(reader), lz4.NewWriter(writer)
+
+	default:
+		return reader, writer
+	}
+}
+
+// Index writes the list of file information for the given folder to the
+// connected peer node. idx is the full, current set of files known
+// locally for the folder; once an index has been sent for the folder (or
+// SetIndexSince has seeded it), only the entries with a Sequence higher
+// than what we've already sent are put on the wire.
+func (c *Connection) Index(folder string, idx []FileInfo) {
 	c.Lock()
 
-	var msgType int
 	if c.indexSent == nil {
-		// This is the first time we send an index.
-		msgType = messageTypeIndex
-
 		c.indexSent = make(map[string]int64)
-		for _, f := range idx {
-			c.indexSent[f.Name] = f.Modified
-		}
+	}
+
+	sent, resuming := c.indexSent[folder]
+
+	var msgType int
+	var toSend []FileInfo
+	if !resuming {
+		// This is the first time we send an index for this folder.
+		msgType = messageTypeIndex
+		toSend = idx
 	} else {
-		// We have sent one full index. Only send updates now.
+		// We have sent one full index for this folder. Only send the
+		// entries the peer doesn't already have.
 		msgType = messageTypeIndexUpdate
-		var diff []FileInfo
 		for _, f := range idx {
-			if modified, ok := c.indexSent[f.Name]; !ok || f.Modified != modified {
-				diff = append(diff, f)
-				c.indexSent[f.Name] = f.Modified
+			if f.Sequence > sent {
+				toSend = append(toSend, f)
 			}
 		}
-		idx = diff
 	}
 
-	c.mwriter.writeHeader(header{0, c.nextId, msgType})
-	c.mwriter.writeIndex(idx)
-	err := c.flush()
+	maxSeq := sent
+	for _, f := range idx {
+		if f.Sequence > maxSeq {
+			maxSeq = f.Sequence
+		}
+	}
+	c.indexSent[folder] = maxSeq
+	c.Unlock()
+
+	// A folder index can be much larger than a single write should ever
+	// block for: writeFrame charges the whole frame against the write
+	// limiter before writerLoop can look at anything else, so one huge
+	// Index frame would starve queued Pings for as long as the limiter
+	// throttles it. Splitting into indexChunkSize-ish batches keeps each
+	// individual wait() bounded, the same way Response payloads are
+	// chunked. Only the first batch keeps msgType; the rest are updates
+	// to what the first batch already announced.
+	first := true
+	for len(toSend) > 0 || first {
+		batch, rest := splitIndexBatch(toSend)
+		toSend = rest
+
+		t := msgType
+		if !first {
+			t = messageTypeIndexUpdate
+		}
+		first = false
+
+		id := c.nextMsgID()
+		size := estimatedIndexSize(batch)
+		c.enqueueControl(size, func(w *marshalWriter) {
+			w.writeHeader(header{0, id, t})
+			w.writeIndex(folder, batch)
+		})
+	}
+}
+
+// indexChunkSize bounds how much of an Index/IndexUpdate's file list goes
+// out in a single frame, for the same reason responseChunkSize bounds
+// Response frames: so writeLimiter.wait blocks the writer goroutine for
+// about one chunk's worth of bytes at most, or one file's worth for a
+// single entry larger than that.
+const indexChunkSize = responseChunkSize
+
+// splitIndexBatch takes the first batch of files whose estimated size
+// fits within indexChunkSize (always at least one file, so a single
+// oversized entry still makes progress) and returns it along with the
+// remaining files.
+func splitIndexBatch(files []FileInfo) (batch, rest []FileInfo) {
+	size := 0
+	for i, f := range files {
+		fsize := estimatedIndexSize(files[i : i+1])
+		if i > 0 && size+fsize > indexChunkSize {
+			return files[:i], files[i:]
+		}
+		size += fsize
+	}
+	return files, nil
+}
+
+// estimatedIndexSize approximates the number of bytes writeIndex will
+// put on the wire, for crediting against the write-rate limiter. A full
+// folder index can be large, so charging it 0 would let it bypass
+// SetWriteLimit entirely; the estimate only needs to be proportionate,
+// not exact.
+func estimatedIndexSize(files []FileInfo) int {
+	const perFileOverhead = 24 // name length, flags, modified, sequence, block count
+	const perBlockOverhead = 4 + 32 // length + hash
+
+	n := 0
+	for _, f := range files {
+		n += perFileOverhead + len(f.Name)
+		n += len(f.Blocks) * perBlockOverhead
+	}
+	return n
+}
+
+// nextMsgID returns the next message ID to use, wrapping as before.
+func (c *Connection) nextMsgID() int {
+	c.Lock()
+	id := c.nextId
 	c.nextId = (c.nextId + 1) & 0xfff
 	c.Unlock()
-	if err != nil || c.mwriter.err != nil {
-		c.close()
-		return
+	return id
+}
+
+// SetIndexSince seeds the per-folder "already sent" sequence, letting a
+// caller that persists sequence numbers across reconnects resume an
+// incremental index exchange instead of retransmitting the full folder.
+// It must be called before the first call to Index for that folder.
+//
+// There is no wire-level exchange of this number: NewConnection does not
+// ask the peer for its highest received sequence on connect. A caller
+// that wants resumable delta transfer across reconnects has to obtain the
+// value the peer's LastReceivedSequence reports for the folder through
+// some channel of its own and pass it here before the first Index.
+func (c *Connection) SetIndexSince(folder string, seq int64) {
+	c.Lock()
+	if c.indexSent == nil {
+		c.indexSent = make(map[string]int64)
+	}
+	c.indexSent[folder] = seq
+	c.Unlock()
+}
+
+// LastReceivedSequence returns the highest FileInfo.Sequence received
+// from the peer for the given folder so far, for callers that want to
+// persist it across reconnects and hand it back to the peer's
+// SetIndexSince through their own out-of-band channel; Connection itself
+// does not exchange this value with the peer.
+func (c *Connection) LastReceivedSequence(folder string) int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.indexReceived[folder]
+}
+
+func (c *Connection) recordReceivedSequence(folder string, files []FileInfo) int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.indexReceived == nil {
+		c.indexReceived = make(map[string]int64)
 	}
+	seq := c.indexReceived[folder]
+	for _, f := range files {
+		if f.Sequence > seq {
+			seq = f.Sequence
+		}
+	}
+	c.indexReceived[folder] = seq
+	return seq
 }
 
-// Request returns the bytes for the specified block after fetching them from the connected peer.
+// Request returns the bytes for the specified block after fetching them
+// from the connected peer. It is a convenience wrapper around
+// RequestStream that reads the stream to completion.
 func (c *Connection) Request(name string, offset uint64, size uint32, hash []byte) ([]byte, error) {
+	rc, err := c.RequestStream(name, offset, size, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// RequestStream requests the bytes for the specified block from the
+// connected peer node and returns them as a stream of chunks, without
+// buffering the whole block in memory. The caller must Close the
+// returned io.ReadCloser; closing it before reaching EOF cancels the
+// request so the peer can stop producing chunks early.
+func (c *Connection) RequestStream(name string, offset uint64, size uint32, hash []byte) (io.ReadCloser, error) {
 	if c.isClosed() {
 		return nil, ErrClosed
 	}
+
+	id := c.nextMsgID()
+	ch := make(chan chunkResult, 8)
 	c.Lock()
-	rc := make(chan asyncResult)
-	c.awaiting[c.nextId] = rc
-	c.mwriter.writeHeader(header{0, c.nextId, messageTypeRequest})
-	c.mwriter.writeRequest(request{name, offset, size, hash})
-	if c.mwriter.err != nil {
-		c.Unlock()
-		c.close()
-		return nil, c.mwriter.err
-	}
-	err := c.flush()
-	if err != nil {
+	c.awaiting[id] = ch
+	c.Unlock()
+
+	c.enqueueControl(0, func(w *marshalWriter) {
+		w.writeHeader(header{0, id, messageTypeRequest})
+		w.writeRequest(request{name, offset, size, hash})
+	})
+
+	return &chunkReader{c: c, id: id, ch: ch}, nil
+}
+
+// cancelRequest tells the peer to stop producing chunks for an in-flight
+// request, e.g. because the caller closed the stream early or the local
+// scheduler dropped interest in the block.
+func (c *Connection) cancelRequest(id int) {
+	c.Lock()
+	if _, ok := c.awaiting[id]; !ok {
 		c.Unlock()
-		c.close()
-		return nil, err
+		return
 	}
-	c.nextId = (c.nextId + 1) & 0xfff
+	delete(c.awaiting, id)
 	c.Unlock()
 
-	res, ok := <-rc
-	if !ok {
-		return nil, ErrClosed
-	}
-	return res.val, res.err
+	c.enqueueControl(0, func(w *marshalWriter) {
+		w.writeHeader(header{0, id, messageTypeCancel})
+	})
 }
 
 func (c *Connection) Ping() (time.Duration, bool) {
 	if c.isClosed() {
 		return 0, false
 	}
+
+	id := c.nextMsgID()
+	rc := make(chan chunkResult)
 	c.Lock()
-	rc := make(chan asyncResult)
-	c.awaiting[c.nextId] = rc
-	t0 := time.Now()
-	c.mwriter.writeHeader(header{0, c.nextId, messageTypePing})
-	err := c.flush()
-	if err != nil || c.mwriter.err != nil {
-		c.Unlock()
-		c.close()
-		return 0, false
-	}
-	c.nextId = (c.nextId + 1) & 0xfff
+	c.awaiting[id] = rc
 	c.Unlock()
 
+	t0 := time.Now()
+	c.enqueueControl(0, func(w *marshalWriter) {
+		w.writeHeader(header{0, id, messageTypePing})
+	})
+
 	_, ok := <-rc
 	return time.Since(t0), ok
 }
@@ -217,9 +675,75 @@ func (c *Connection) close() {
 	c.awaiting = nil
 	c.Unlock()
 
+	close(c.closedCh)
+
 	c.receiver.Close(c.ID)
 }
 
+// enqueueControl hands a small, latency-sensitive frame to the writer
+// goroutine. It blocks while controlQueue is full, but not once the
+// connection has started closing.
+func (c *Connection) enqueueControl(size int, write func(*marshalWriter)) {
+	select {
+	case c.controlQueue <- frame{write, size}:
+	case <-c.closedCh:
+	}
+}
+
+// enqueueData hands a Response payload frame to the writer goroutine.
+// It blocks while the data queue is full; that queue holds only
+// dataQueueSize frames, which bounds memory for a peer that isn't reading
+// fast enough. It reports whether the frame was handed off, false meaning the
+// connection closed first.
+func (c *Connection) enqueueData(size int, write func(*marshalWriter)) bool {
+	select {
+	case c.dataQueue <- frame{write, size}:
+		return true
+	case <-c.closedCh:
+		return false
+	}
+}
+
+// writerLoop is the sole writer of the connection's underlying stream.
+// It always drains controlQueue before dataQueue, so Ping/Pong, Index
+// and Request frames aren't stuck behind a backlog of Response payloads
+// on a saturated link.
+func (c *Connection) writerLoop() {
+	for {
+		select {
+		case f := <-c.controlQueue:
+			c.writeFrame(f)
+			continue
+		case <-c.closedCh:
+			return
+		default:
+		}
+
+		select {
+		case f := <-c.controlQueue:
+			c.writeFrame(f)
+		case f := <-c.dataQueue:
+			c.writeFrame(f)
+		case <-c.closedCh:
+			return
+		}
+	}
+}
+
+func (c *Connection) writeFrame(f frame) {
+	if f.size > 0 {
+		c.writeLimiter.wait(f.size)
+	}
+
+	c.Lock()
+	f.write(c.mwriter)
+	err := c.flush()
+	c.Unlock()
+	if err != nil || c.mwriter.err != nil {
+		c.close()
+	}
+}
+
 func (c *Connection) isClosed() bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -245,19 +769,21 @@ func (c *Connection) readerLoop() {
 
 		switch hdr.msgType {
 		case messageTypeIndex:
-			files := c.mreader.readIndex()
+			folder, files := c.mreader.readIndex()
 			if c.mreader.err != nil {
 				c.close()
 			} else {
-				c.receiver.Index(c.ID, files)
+				seq := c.recordReceivedSequence(folder, files)
+				c.receiver.Index(c.ID, folder, seq, files)
 			}
 
 		case messageTypeIndexUpdate:
-			files := c.mreader.readIndex()
+			folder, files := c.mreader.readIndex()
 			if c.mreader.err != nil {
 				c.close()
 			} else {
-				c.receiver.IndexUpdate(c.ID, files)
+				seq := c.recordReceivedSequence(folder, files)
+				c.receiver.IndexUpdate(c.ID, folder, seq, files)
 			}
 
 		case messageTypeRequest:
@@ -266,7 +792,7 @@ func (c *Connection) readerLoop() {
 				c.close()
 			}
 
-		case messageTypeResponse:
+		case messageTypeResponseChunk:
 			data := c.mreader.readResponse()
 
 			if c.mreader.err != nil {
@@ -277,31 +803,43 @@ func (c *Connection) readerLoop() {
 				c.RUnlock()
 
 				if ok {
-					rc <- asyncResult{data, c.mreader.err}
-					close(rc)
-
-					c.Lock()
-					delete(c.awaiting, hdr.msgID)
-					c.Unlock()
+					rc <- chunkResult{data: data}
 				}
 			}
 
-		case messageTypePing:
+		case messageTypeResponseEnd:
 			c.Lock()
-			c.mwriter.writeUint32(encodeHeader(header{0, hdr.msgID, messageTypePong}))
-			err := c.flush()
+			rc, ok := c.awaiting[hdr.msgID]
+			delete(c.awaiting, hdr.msgID)
 			c.Unlock()
-			if err != nil || c.mwriter.err != nil {
-				c.close()
+
+			if ok {
+				close(rc)
 			}
 
+		case messageTypeCancel:
+			c.Lock()
+			if c.inFlightRequests[hdr.msgID] {
+				if c.cancelled == nil {
+					c.cancelled = make(map[int]bool)
+				}
+				c.cancelled[hdr.msgID] = true
+			}
+			c.Unlock()
+
+		case messageTypePing:
+			msgID := hdr.msgID
+			c.enqueueControl(0, func(w *marshalWriter) {
+				w.writeUint32(encodeHeader(header{0, msgID, messageTypePong}))
+			})
+
 		case messageTypePong:
 			c.RLock()
 			rc, ok := c.awaiting[hdr.msgID]
 			c.RUnlock()
 
 			if ok {
-				rc <- asyncResult{}
+				rc <- chunkResult{}
 				close(rc)
 
 				c.Lock()
@@ -320,20 +858,97 @@ func (c *Connection) processRequest(msgID int) {
 	req := c.mreader.readRequest()
 	if c.mreader.err != nil {
 		c.close()
-	} else {
-		go func() {
-			data, _ := c.receiver.Request(c.ID, req.name, req.offset, req.size, req.hash)
-			c.Lock()
-			c.mwriter.writeUint32(encodeHeader(header{0, msgID, messageTypeResponse}))
-			c.mwriter.writeResponse(data)
-			err := c.flush()
-			c.Unlock()
-			buffers.Put(data)
-			if c.mwriter.err != nil || err != nil {
-				c.close()
-			}
-		}()
+		return
 	}
+
+	c.Lock()
+	if c.inFlightRequests == nil {
+		c.inFlightRequests = make(map[int]bool)
+	}
+	c.inFlightRequests[msgID] = true
+	c.Unlock()
+
+	go func() {
+		defer c.finishRequest(msgID)
+
+		if sm, ok := c.receiver.(StreamingModel); ok {
+			rc, err := sm.RequestStream(c.ID, req.name, req.offset, req.size, req.hash)
+			if err != nil {
+				c.writeResponseEnd(msgID)
+				return
+			}
+			defer rc.Close()
+
+			buf := make([]byte, responseChunkSize)
+			for {
+				if c.isCancelled(msgID) {
+					return
+				}
+				n, err := rc.Read(buf)
+				if n > 0 && !c.writeResponseChunk(msgID, buf[:n]) {
+					return
+				}
+				if err != nil {
+					c.writeResponseEnd(msgID)
+					return
+				}
+			}
+		}
+
+		data, _ := c.receiver.Request(c.ID, req.name, req.offset, req.size, req.hash)
+		defer buffers.Put(data)
+
+		for len(data) > 0 && !c.isCancelled(msgID) {
+			n := responseChunkSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if !c.writeResponseChunk(msgID, data[:n]) {
+				return
+			}
+			data = data[n:]
+		}
+		c.writeResponseEnd(msgID)
+	}()
+}
+
+// writeResponseChunk and writeResponseEnd share the data queue (rather
+// than the control queue) so that, for a given request, chunks and the
+// terminating end frame are never reordered relative to one another.
+func (c *Connection) writeResponseChunk(msgID int, data []byte) bool {
+	// data may point into a buffer the caller reuses or returns to a pool
+	// as soon as this call returns; the actual write happens later, from
+	// writerLoop, so it needs its own copy rather than a reference into
+	// memory it doesn't own.
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	return c.enqueueData(len(cp), func(w *marshalWriter) {
+		w.writeUint32(encodeHeader(header{0, msgID, messageTypeResponseChunk}))
+		w.writeResponse(cp)
+	})
+}
+
+func (c *Connection) writeResponseEnd(msgID int) {
+	c.enqueueData(0, func(w *marshalWriter) {
+		w.writeUint32(encodeHeader(header{0, msgID, messageTypeResponseEnd}))
+	})
+}
+
+func (c *Connection) isCancelled(msgID int) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cancelled[msgID]
+}
+
+// finishRequest marks msgID as no longer in flight and clears any
+// cancellation recorded for it, so a late or unmatched Cancel for this ID
+// can never be mistaken for one targeting a future request that reuses
+// the same 12-bit ID.
+func (c *Connection) finishRequest(msgID int) {
+	c.Lock()
+	delete(c.inFlightRequests, msgID)
+	delete(c.cancelled, msgID)
+	c.Unlock()
 }
 
 func (c *Connection) pingerLoop() {
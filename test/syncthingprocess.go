@@ -11,6 +11,7 @@ package integration
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/syncthing/protocol"
@@ -42,6 +44,11 @@ type syncthingProcess struct {
 
 	cmd   *exec.Cmd
 	logfd *os.File
+
+	eventLoopOnce sync.Once
+	eventLoopDone chan struct{}
+	eventMut      sync.Mutex
+	eventSubs     map[string][]*eventWaiter
 }
 
 func (p *syncthingProcess) start() error {
@@ -110,6 +117,10 @@ func (p *syncthingProcess) stop() error {
 	p.cmd.Process.Signal(os.Kill)
 	p.cmd.Wait()
 
+	if p.eventLoopDone != nil {
+		close(p.eventLoopDone)
+	}
+
 	fd, err := os.Open(p.logfd.Name())
 	if err != nil {
 		return err
@@ -263,7 +274,11 @@ type event struct {
 }
 
 func (p *syncthingProcess) events() ([]event, error) {
-	resp, err := p.get(fmt.Sprintf("/rest/events?since=%d", p.lastEvent))
+	p.eventMut.Lock()
+	since := p.lastEvent
+	p.eventMut.Unlock()
+
+	resp, err := p.get(fmt.Sprintf("/rest/events?since=%d", since))
 	if err != nil {
 		return nil, err
 	}
@@ -274,10 +289,200 @@ func (p *syncthingProcess) events() ([]event, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	p.eventMut.Lock()
 	p.lastEvent = evs[len(evs)-1].ID
+	p.eventMut.Unlock()
 	return evs, err
 }
 
+// eventWaiter is a single WaitForEvent call's registration with the
+// background event loop: it is handed every event of the given type and
+// decides, via match, whether to deliver it.
+type eventWaiter struct {
+	match func(event) bool
+	ch    chan event
+}
+
+// WaitForEvent blocks until an event of the given type for which match
+// returns true is observed, or ctx is done. It lets tests assert on
+// precise causal events (e.g. "item X finished") instead of polling
+// coarse completion state, which is both faster and less flaky.
+func (p *syncthingProcess) WaitForEvent(ctx context.Context, typ string, match func(event) bool) (event, error) {
+	p.startEventLoop()
+
+	w := &eventWaiter{match: match, ch: make(chan event, 1)}
+
+	p.eventMut.Lock()
+	p.eventSubs[typ] = append(p.eventSubs[typ], w)
+	p.eventMut.Unlock()
+
+	defer p.removeEventWaiter(typ, w)
+
+	select {
+	case ev := <-w.ch:
+		return ev, nil
+	case <-ctx.Done():
+		return event{}, ctx.Err()
+	}
+}
+
+func (p *syncthingProcess) removeEventWaiter(typ string, w *eventWaiter) {
+	p.eventMut.Lock()
+	defer p.eventMut.Unlock()
+	subs := p.eventSubs[typ]
+	for i, s := range subs {
+		if s == w {
+			p.eventSubs[typ] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+// startEventLoop launches, once per process, a goroutine that long-polls
+// /rest/events and demultiplexes the results to registered waiters. The
+// goroutine runs until stop() closes eventLoopDone.
+func (p *syncthingProcess) startEventLoop() {
+	p.eventLoopOnce.Do(func() {
+		p.eventSubs = make(map[string][]*eventWaiter)
+		p.eventLoopDone = make(chan struct{})
+		go p.eventLoop()
+	})
+}
+
+func (p *syncthingProcess) eventLoop() {
+	for {
+		select {
+		case <-p.eventLoopDone:
+			return
+		default:
+		}
+
+		evs, err := p.pollEvents()
+		if err != nil {
+			select {
+			case <-p.eventLoopDone:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		p.eventMut.Lock()
+		for _, ev := range evs {
+			for _, w := range p.eventSubs[ev.Type] {
+				if w.match == nil || w.match(ev) {
+					select {
+					case w.ch <- ev:
+					default:
+						// Waiter already has a delivered event pending; drop.
+					}
+				}
+			}
+		}
+		p.eventMut.Unlock()
+	}
+}
+
+// pollEvents long-polls /rest/events, blocking on the server side for up
+// to 60s for a new event rather than returning immediately.
+func (p *syncthingProcess) pollEvents() ([]event, error) {
+	p.eventMut.Lock()
+	since := p.lastEvent
+	p.eventMut.Unlock()
+
+	client := &http.Client{
+		Timeout: 65 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/rest/events?since=%d&timeout=60", p.port, since), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.apiKey != "" {
+		req.Header.Add("X-API-Key", p.apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var evs []event
+	if err := json.NewDecoder(resp.Body).Decode(&evs); err != nil {
+		return nil, err
+	}
+	if len(evs) > 0 {
+		p.eventMut.Lock()
+		p.lastEvent = evs[len(evs)-1].ID
+		p.eventMut.Unlock()
+	}
+	return evs, nil
+}
+
+// ItemStartedData is the Data payload of an "ItemStarted" event.
+type ItemStartedData struct {
+	Item   string
+	Folder string
+}
+
+// ItemFinishedData is the Data payload of an "ItemFinished" event.
+type ItemFinishedData struct {
+	Item   string
+	Folder string
+	Error  string
+}
+
+// FolderCompletionData is the Data payload of a "FolderCompletion" event.
+type FolderCompletionData struct {
+	Folder     string
+	Completion float64
+}
+
+// DeviceConnectedData is the Data payload of a "DeviceConnected" event.
+type DeviceConnectedData struct {
+	ID   string
+	Addr string
+}
+
+func (e event) AsItemStarted() (ItemStartedData, error) {
+	var d ItemStartedData
+	err := decodeEventData(e, &d)
+	return d, err
+}
+
+func (e event) AsItemFinished() (ItemFinishedData, error) {
+	var d ItemFinishedData
+	err := decodeEventData(e, &d)
+	return d, err
+}
+
+func (e event) AsFolderCompletion() (FolderCompletionData, error) {
+	var d FolderCompletionData
+	err := decodeEventData(e, &d)
+	return d, err
+}
+
+func (e event) AsDeviceConnected() (DeviceConnectedData, error) {
+	var d DeviceConnectedData
+	err := decodeEventData(e, &d)
+	return d, err
+}
+
+// decodeEventData re-marshals the generically decoded event.Data back to
+// JSON and unmarshals it into a typed struct, avoiding a second HTTP
+// round trip just to get a concrete type.
+func decodeEventData(e event, out interface{}) error {
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
 type versionResp struct {
 	Version string
 }